@@ -0,0 +1,77 @@
+package brotlipatch
+
+import "crypto/sha256"
+
+// Content-defined chunking via a gear hash: cheap (one table lookup and
+// a shift-add per byte), and unlike fixed-size blocks, boundaries follow
+// the data itself, so an insertion or deletion in the middle of a file
+// only perturbs the chunks touching the edit instead of every chunk
+// after it.
+const (
+	minChunkSize = 1024
+	maxChunkSize = 16 * 1024
+	avgChunkSize = 4 * 1024
+	chunkMask    = avgChunkSize - 1
+)
+
+// gearTable is a fixed, arbitrary 256-entry table of 64-bit values used
+// to roll the gear hash. It only needs to be well distributed and the
+// same across a single diff/apply pair; it's hardcoded for determinism.
+var gearTable = makeGearTable()
+
+func makeGearTable() [256]uint64 {
+	var table [256]uint64
+	// splitmix64, seeded with a constant, to fill the table with
+	// well-distributed values without pulling in math/rand.
+	seed := uint64(0x9e3779b97f4a7c15)
+	for i := range table {
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}
+
+// chunk is a content-defined slice of a file, identified by the SHA-256
+// of its bytes so equal chunks in two different files hash equal
+// regardless of where they land.
+type chunk struct {
+	Offset int64
+	Length int64
+	Hash   [32]byte
+}
+
+// chunkify splits data on gear hash boundaries, never producing a chunk
+// smaller than minChunkSize (except possibly the last one) or larger
+// than maxChunkSize.
+func chunkify(data []byte) []chunk {
+	if len(data) == 0 {
+		return nil
+	}
+
+	var chunks []chunk
+	start := 0
+	var h uint64
+
+	for i, b := range data {
+		h = (h << 1) + gearTable[b]
+		length := i - start + 1
+		if length >= maxChunkSize || (length >= minChunkSize && h&chunkMask == 0) {
+			chunks = append(chunks, newChunk(data[start:i+1], int64(start)))
+			start = i + 1
+			h = 0
+		}
+	}
+
+	if start < len(data) {
+		chunks = append(chunks, newChunk(data[start:], int64(start)))
+	}
+
+	return chunks
+}
+
+func newChunk(b []byte, offset int64) chunk {
+	return chunk{Offset: offset, Length: int64(len(b)), Hash: sha256.Sum256(b)}
+}
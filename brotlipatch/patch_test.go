@@ -0,0 +1,76 @@
+package brotlipatch
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// applyCopyPatch writes a patch consisting of a single COPY(offset,
+// length) opcode against a 5-byte old file and runs Apply against it,
+// returning whatever error (if any) comes back.
+func applyCopyPatch(t *testing.T, offset int64, length int64) error {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "brotlipatch-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldPath := filepath.Join(dir, "old")
+	patchPath := filepath.Join(dir, "patch")
+	newPath := filepath.Join(dir, "new")
+
+	if err := ioutil.WriteFile(oldPath, []byte("hello"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	if err := writeCopy(w, offset, length); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeDone(w, make([]byte, 32)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(patchPath, buf.Bytes(), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	return Apply(oldPath, patchPath, newPath)
+}
+
+// TestApplyRejectsOutOfBoundsCopy builds a patch whose single COPY opcode
+// points past the end of the old file, and checks that Apply returns a
+// *CorruptPatchErr instead of panicking on the out-of-bounds slice.
+func TestApplyRejectsOutOfBoundsCopy(t *testing.T) {
+	err := applyCopyPatch(t, 0, 100)
+	if err == nil {
+		t.Fatal("expected an error for an out-of-bounds COPY")
+	}
+	if _, ok := err.(*CorruptPatchErr); !ok {
+		t.Fatalf("expected *CorruptPatchErr, got %T: %s", err, err)
+	}
+}
+
+// TestApplyRejectsOverflowingCopy covers offset+length values large
+// enough to overflow int64 and wrap negative, which would slip past a
+// bounds check performed after the addition instead of before it.
+func TestApplyRejectsOverflowingCopy(t *testing.T) {
+	const huge = int64(1) << 62
+
+	err := applyCopyPatch(t, huge, huge)
+	if err == nil {
+		t.Fatal("expected an error for an overflowing COPY")
+	}
+	if _, ok := err.(*CorruptPatchErr); !ok {
+		t.Fatalf("expected *CorruptPatchErr, got %T: %s", err, err)
+	}
+}
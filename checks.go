@@ -1,22 +1,23 @@
 package main
 
 import (
-	"bytes"
-	"crypto/md5"
-	"encoding/base64"
 	"fmt"
-	"hash/crc32"
-	"io"
 	"net/http"
 	"os"
-	"strings"
 	"time"
 
 	"github.com/go-errors/errors"
+	"github.com/itchio/butler/brotlipatch"
 	"github.com/itchio/butler/comm"
-	"github.com/itchio/wharf/crc32c"
+	"github.com/itchio/butler/hashverify"
 )
 
+// dlArgs holds the flags that affect hash verification during a dl;
+// dl() populates it before it starts downloading.
+var dlArgs = struct {
+	thorough *bool
+}{thorough: new(bool)}
+
 type BadSizeErr struct {
 	Expected int64
 	Actual   int64
@@ -43,6 +44,9 @@ func IsIntegrityError(err error) bool {
 	if _, ok := err.(*BadHashErr); ok {
 		return true
 	}
+	if _, ok := err.(*brotlipatch.CorruptPatchErr); ok {
+		return true
+	}
 
 	if original, ok := err.(*errors.Error); ok {
 		return IsIntegrityError(original.Err)
@@ -52,6 +56,15 @@ func IsIntegrityError(err error) bool {
 }
 
 func checkIntegrity(header http.Header, contentLength int64, file string) error {
+	return checkIntegrityWithPrecomputed(header, contentLength, file, nil)
+}
+
+// checkIntegrityWithPrecomputed is checkIntegrity, but any digest
+// already present in precomputed is checked against that value directly
+// instead of triggering a file read. The downloader uses this to verify
+// a chunked download's CRC32C from its per-chunk checksums without a
+// second full pass over the file.
+func checkIntegrityWithPrecomputed(header http.Header, contentLength int64, file string, precomputed map[string][]byte) error {
 	diskSize := int64(0)
 	stats, err := os.Lstat(file)
 	if err == nil {
@@ -71,97 +84,47 @@ func checkIntegrity(header http.Header, contentLength int64, file string) error
 		comm.Debugf("%10s pass (%d bytes)", "size", diskSize)
 	}
 
-	return checkHashes(header, file)
+	return checkHashes(header, file, precomputed)
 }
 
-func checkHashes(header http.Header, file string) error {
-	googHashes := header[http.CanonicalHeaderKey("x-goog-hash")]
-
-	for _, googHash := range googHashes {
-		tokens := strings.SplitN(googHash, "=", 2)
-		hashType := tokens[0]
-		hashValue, err := base64.StdEncoding.DecodeString(tokens[1])
-		if err != nil {
-			comm.Logf("Could not verify %s hash: %s", hashType, err)
-			continue
-		}
-
-		start := time.Now()
-		checked, err := checkHash(hashType, hashValue, file)
-		if err != nil {
-			return errors.Wrap(err, 1)
-		}
-
-		if checked {
-			comm.Debugf("%10s pass (took %s)", hashType, time.Since(start))
-		} else {
-			comm.Debugf("%10s skip (use --thorough to force check)", hashType)
-		}
+// checkHashes parses every digest it recognizes out of header (Google's
+// x-goog-hash, RFC 3230 Digest / RFC 9530 Repr-Digest, S3-style
+// x-amz-checksum-*) and verifies file against them in a single pass,
+// skipping the file entirely for any algorithm already present in
+// precomputed.
+func checkHashes(header http.Header, file string, precomputed map[string][]byte) error {
+	digests := hashverify.ParseHeaders(header)
+	if len(digests) == 0 {
+		return nil
 	}
 
-	return nil
-}
-
-func checkHash(hashType string, hashValue []byte, file string) (checked bool, err error) {
-	checked = true
-
-	switch hashType {
-	case "md5":
-		if *dlArgs.thorough {
-			err = checkHashMD5(hashValue, file)
-		} else {
-			checked = false
+	wanted := make(map[string][]byte)
+	for algo, value := range digests {
+		if algo == "md5" && !*dlArgs.thorough {
+			comm.Debugf("%10s skip (use --thorough to force check)", algo)
+			continue
 		}
-	case "crc32c":
-		err = checkHashCRC32C(hashValue, file)
-	default:
-		checked = false
+		wanted[algo] = value
 	}
 
+	start := time.Now()
+	checked, err := hashverify.Default.VerifyWithPrecomputed(file, wanted, precomputed)
 	if err != nil {
-		err = errors.Wrap(err, 1)
-	}
-	return
-}
-
-func checkHashMD5(hashValue []byte, file string) error {
-	fr, err := os.Open(file)
-	if err != nil {
-		return errors.Wrap(err, 1)
-	}
-	defer fr.Close()
-
-	hasher := md5.New()
-	io.Copy(hasher, fr)
-
-	hashComputed := hasher.Sum(nil)
-	if !bytes.Equal(hashValue, hashComputed) {
-		return &BadHashErr{
-			Algo:     "md5",
-			Actual:   hashComputed,
-			Expected: hashValue,
+		if mismatch, ok := err.(*hashverify.Mismatch); ok {
+			return &BadHashErr{
+				Algo:     mismatch.Algo,
+				Expected: mismatch.Expected,
+				Actual:   mismatch.Actual,
+			}
 		}
-	}
-
-	return nil
-}
-
-func checkHashCRC32C(hashValue []byte, file string) error {
-	fr, err := os.Open(file)
-	if err != nil {
 		return errors.Wrap(err, 1)
 	}
-	defer fr.Close()
 
-	hasher := crc32.New(crc32c.Table)
-	io.Copy(hasher, fr)
-
-	hashComputed := hasher.Sum(nil)
-	if !bytes.Equal(hashValue, hashComputed) {
-		return &BadHashErr{
-			Algo:     "crc32c",
-			Actual:   hashComputed,
-			Expected: hashValue,
+	for algo := range wanted {
+		if checked[algo] {
+			comm.Debugf("%10s pass (took %s)", algo, time.Since(start))
+		} else {
+			comm.Debugf("%10s skip (unsupported algorithm)", algo)
 		}
 	}
 
@@ -0,0 +1,65 @@
+package main
+
+// crc32Combine computes the CRC32 (under the given reflected polynomial,
+// e.g. crc32.Castagnoli for CRC32C) of the concatenation of two byte
+// spans, given only the individual CRCs of each span and the length of
+// the second one. This is what lets fetchChunk's per-chunk CRC32C add up
+// to a whole-file checksum without a second read of the file: CRC is
+// linear over GF(2), so crc(a||b) can be derived from crc(a), crc(b) and
+// len(b) alone.
+func crc32Combine(poly uint32, crc1 uint32, crc2 uint32, len2 int64) uint32 {
+	if len2 == 0 {
+		return crc1
+	}
+
+	even := make([]uint32, 32)
+	odd := make([]uint32, 32)
+
+	odd[0] = poly
+	row := uint32(1)
+	for n := 1; n < 32; n++ {
+		odd[n] = row
+		row <<= 1
+	}
+
+	gf2MatrixSquare(even, odd)
+	gf2MatrixSquare(odd, even)
+
+	for {
+		gf2MatrixSquare(even, odd)
+		if len2&1 != 0 {
+			crc1 = gf2MatrixTimes(even, crc1)
+		}
+		len2 >>= 1
+		if len2 == 0 {
+			break
+		}
+		gf2MatrixSquare(odd, even)
+		if len2&1 != 0 {
+			crc1 = gf2MatrixTimes(odd, crc1)
+		}
+		len2 >>= 1
+		if len2 == 0 {
+			break
+		}
+	}
+
+	return crc1 ^ crc2
+}
+
+func gf2MatrixTimes(mat []uint32, vec uint32) uint32 {
+	var sum uint32
+	for i := 0; vec != 0; i++ {
+		if vec&1 != 0 {
+			sum ^= mat[i]
+		}
+		vec >>= 1
+	}
+	return sum
+}
+
+func gf2MatrixSquare(square []uint32, mat []uint32) {
+	for i := range mat {
+		square[i] = gf2MatrixTimes(mat, mat[i])
+	}
+}
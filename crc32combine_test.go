@@ -0,0 +1,31 @@
+package main
+
+import (
+	"hash/crc32"
+	"testing"
+)
+
+func TestCrc32Combine(t *testing.T) {
+	tab := crc32.MakeTable(crc32.Castagnoli)
+	a := []byte("hello, ")
+	b := []byte("world! this is butler")
+
+	crcA := crc32.Checksum(a, tab)
+	crcB := crc32.Checksum(b, tab)
+	want := crc32.Checksum(append(append([]byte{}, a...), b...), tab)
+
+	got := crc32Combine(crc32.Castagnoli, crcA, crcB, int64(len(b)))
+	if got != want {
+		t.Fatalf("crc32Combine(%x, %x, %d) = %x, want %x", crcA, crcB, len(b), got, want)
+	}
+}
+
+func TestCrc32CombineEmptySecond(t *testing.T) {
+	tab := crc32.MakeTable(crc32.Castagnoli)
+	crcA := crc32.Checksum([]byte("anything"), tab)
+
+	got := crc32Combine(crc32.Castagnoli, crcA, 0, 0)
+	if got != crcA {
+		t.Fatalf("combining with an empty second span changed the crc: got %x, want %x", got, crcA)
+	}
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/go-errors/errors"
+	"github.com/itchio/butler/comm"
+	"github.com/itchio/wharf/crc32c"
+)
+
+// Sink is anywhere a downloader can write chunks of bytes at arbitrary
+// offsets. Local files, io.WriterAt wrappers, and multipart cloud-storage
+// uploads can all implement it.
+type Sink interface {
+	WriteAt(p []byte, off int64) (int, error)
+	Sync() error
+	Close() error
+}
+
+// fileSink is the default Sink, backed by a local file opened for
+// read-write.
+type fileSink struct {
+	f *os.File
+}
+
+func newFileSink(path string) (*fileSink, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, errors.Wrap(err, 1)
+	}
+	return &fileSink{f: f}, nil
+}
+
+func (fs *fileSink) WriteAt(p []byte, off int64) (int, error) {
+	return fs.f.WriteAt(p, off)
+}
+
+func (fs *fileSink) Sync() error {
+	return fs.f.Sync()
+}
+
+func (fs *fileSink) Close() error {
+	return fs.f.Close()
+}
+
+const defaultNumWorkers = 4
+const chunkSize = int64(4 * 1024 * 1024)
+
+// chunkState tracks the progress of a single range of the download. Once
+// Done is true, CRC32C holds the checksum of the bytes written at
+// [Offset, Offset+Length).
+type chunkState struct {
+	Offset int64
+	Length int64
+	Done   bool
+	CRC32C uint32
+}
+
+// partManifest is the sidecar file (dest + ".part") that lets a download
+// resume after an interruption: it records which chunks have already
+// landed on disk, and their checksums, so a resumed Do never re-fetches
+// bytes it doesn't have to.
+type partManifest struct {
+	URL       string
+	Total     int64
+	ChunkSize int64
+	Chunks    []chunkState
+}
+
+func partManifestPath(dest string) string {
+	return dest + ".part"
+}
+
+func loadPartManifest(dest string) (*partManifest, error) {
+	raw, err := ioutil.ReadFile(partManifestPath(dest))
+	if err != nil {
+		return nil, err
+	}
+
+	pm := &partManifest{}
+	if err := json.Unmarshal(raw, pm); err != nil {
+		return nil, errors.Wrap(err, 1)
+	}
+	return pm, nil
+}
+
+func (pm *partManifest) save(dest string) error {
+	raw, err := json.Marshal(pm)
+	if err != nil {
+		return errors.Wrap(err, 1)
+	}
+	return ioutil.WriteFile(partManifestPath(dest), raw, 0666)
+}
+
+func (pm *partManifest) clear(dest string) {
+	os.Remove(partManifestPath(dest))
+}
+
+func newPartManifest(url string, total int64) *partManifest {
+	pm := &partManifest{
+		URL:       url,
+		Total:     total,
+		ChunkSize: chunkSize,
+	}
+
+	for offset := int64(0); offset < total; offset += chunkSize {
+		length := chunkSize
+		if offset+length > total {
+			length = total - offset
+		}
+		pm.Chunks = append(pm.Chunks, chunkState{Offset: offset, Length: length})
+	}
+
+	return pm
+}
+
+// downloader drives a concurrent, resumable download of a single URL into
+// a Sink, writing its progress to a partManifest sidecar as it goes.
+type downloader struct {
+	url    string
+	dest   string
+	client *http.Client
+
+	numWorkers int
+
+	mutex    sync.Mutex
+	manifest *partManifest
+	written  int64
+}
+
+// newDownloader prepares a downloader for url -> dest. numWorkers <= 0
+// falls back to defaultNumWorkers.
+func newDownloader(url string, dest string, numWorkers int) *downloader {
+	if numWorkers <= 0 {
+		numWorkers = defaultNumWorkers
+	}
+	return &downloader{
+		url:        url,
+		dest:       dest,
+		client:     &http.Client{},
+		numWorkers: numWorkers,
+	}
+}
+
+// Do runs the download to completion. When the server accepts range
+// requests, it resumes from dest+".part" if one exists, verifies the file
+// against header and contentLength via checkIntegrityWithPrecomputed,
+// and clears the manifest once that passes. Otherwise it falls back to
+// doSingleStream, which does not read or write a .part manifest.
+func (d *downloader) Do() error {
+	req, err := http.NewRequest("HEAD", d.url, nil)
+	if err != nil {
+		return errors.Wrap(err, 1)
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, 1)
+	}
+	resp.Body.Close()
+
+	acceptsRanges := resp.Header.Get("Accept-Ranges") == "bytes"
+	if !acceptsRanges || resp.ContentLength <= 0 {
+		comm.Debugf("server doesn't support range requests, falling back to single-stream download")
+		return d.doSingleStream()
+	}
+
+	if d.manifest, err = loadPartManifest(d.dest); err != nil {
+		d.manifest = newPartManifest(d.url, resp.ContentLength)
+	} else if d.manifest.URL != d.url || d.manifest.Total != resp.ContentLength {
+		comm.Debugf("stale .part manifest (url or size changed), starting over")
+		d.manifest = newPartManifest(d.url, resp.ContentLength)
+	}
+
+	sink, err := newFileSink(d.dest)
+	if err != nil {
+		return err
+	}
+	defer sink.Close()
+
+	if err := d.runChunks(sink, resp.Header); err != nil {
+		return err
+	}
+
+	d.manifest.clear(d.dest)
+	return nil
+}
+
+func (d *downloader) runChunks(sink Sink, header http.Header) error {
+	indices := make(chan int)
+	errs := make(chan error, d.numWorkers)
+	// done is closed the moment any worker fails, so the producer loop
+	// below stops trying to feed a channel nobody is draining anymore
+	// instead of blocking forever on a send with zero live consumers.
+	done := make(chan struct{})
+	var closeOnce sync.Once
+
+	var wg sync.WaitGroup
+	for w := 0; w < d.numWorkers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indices {
+				if err := d.fetchChunk(sink, i); err != nil {
+					errs <- err
+					closeOnce.Do(func() { close(done) })
+					return
+				}
+			}
+		}()
+	}
+
+feed:
+	for i, chunk := range d.manifest.Chunks {
+		if chunk.Done {
+			continue
+		}
+		select {
+		case indices <- i:
+		case <-done:
+			break feed
+		}
+	}
+	close(indices)
+	wg.Wait()
+	close(errs)
+
+	if err := <-errs; err != nil {
+		return err
+	}
+
+	return checkIntegrityWithPrecomputed(header, d.manifest.Total, d.dest, d.precomputedDigests())
+}
+
+// precomputedDigests combines the per-chunk CRC32C checksums recorded in
+// the manifest into a whole-file CRC32C, so the final integrity check
+// doesn't need a second read of the file just to confirm x-goog-hash's
+// crc32c. It returns nil if any chunk is missing its checksum (e.g. a
+// fresh manifest that went straight to a fallback path).
+func (d *downloader) precomputedDigests() map[string][]byte {
+	chunks := d.manifest.Chunks
+	if len(chunks) == 0 || !chunks[0].Done {
+		return nil
+	}
+
+	combined := chunks[0].CRC32C
+	for _, c := range chunks[1:] {
+		if !c.Done {
+			return nil
+		}
+		combined = crc32Combine(crc32.Castagnoli, combined, c.CRC32C, c.Length)
+	}
+
+	buf := make([]byte, 4)
+	binary.BigEndian.PutUint32(buf, combined)
+	return map[string][]byte{"crc32c": buf}
+}
+
+// fetchChunk downloads a single byte range, computes its CRC32C in-line
+// (so the final pass doesn't have to re-read the whole file), writes it
+// to the sink, and records it, with that CRC32C, as done in the manifest.
+func (d *downloader) fetchChunk(sink Sink, index int) error {
+	chunk := d.manifest.Chunks[index]
+
+	req, err := http.NewRequest("GET", d.url, nil)
+	if err != nil {
+		return errors.Wrap(err, 1)
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", chunk.Offset, chunk.Offset+chunk.Length-1))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, 1)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusPartialContent && resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("server refused range request: http %s", resp.Status)
+	}
+
+	hasher := crc32.New(crc32c.Table)
+	tr := io.TeeReader(resp.Body, hasher)
+
+	buf := make([]byte, chunk.Length)
+	if _, err := io.ReadFull(tr, buf); err != nil {
+		return errors.Wrap(err, 1)
+	}
+
+	if _, err := sink.WriteAt(buf, chunk.Offset); err != nil {
+		return errors.Wrap(err, 1)
+	}
+
+	d.mutex.Lock()
+	chunk.Done = true
+	chunk.CRC32C = hasher.Sum32()
+	d.manifest.Chunks[index] = chunk
+	d.written += chunk.Length
+	written, total := d.written, d.manifest.Total
+	d.manifest.save(d.dest)
+	d.mutex.Unlock()
+
+	comm.Progress(float64(written) / float64(total))
+	out.Progress(float64(written) / float64(total))
+
+	return nil
+}
+
+// doSingleStream is the fallback used when the server doesn't advertise
+// Accept-Ranges: bytes, behaving like the original single-connection dl.
+func (d *downloader) doSingleStream() error {
+	sink, err := newFileSink(d.dest)
+	if err != nil {
+		return err
+	}
+	defer sink.Close()
+
+	req, err := http.NewRequest("GET", d.url, nil)
+	if err != nil {
+		return errors.Wrap(err, 1)
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, 1)
+	}
+	defer resp.Body.Close()
+
+	written := int64(0)
+	buf := make([]byte, bufferSize)
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			if _, werr := sink.WriteAt(buf[:n], written); werr != nil {
+				return errors.Wrap(werr, 1)
+			}
+			written += int64(n)
+			if resp.ContentLength > 0 {
+				comm.Progress(float64(written) / float64(resp.ContentLength))
+				out.Progress(float64(written) / float64(resp.ContentLength))
+			}
+		}
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return errors.Wrap(err, 1)
+		}
+	}
+
+	return checkIntegrity(resp.Header, resp.ContentLength, d.dest)
+}
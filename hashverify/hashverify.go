@@ -0,0 +1,233 @@
+// Package hashverify knows how to pull digests out of an HTTP response
+// (Google's x-goog-hash, RFC 3230 Digest / RFC 9530 Repr-Digest, and
+// S3-style x-amz-checksum-*) and check a file against them, computing
+// every requested algorithm in a single pass over the file.
+package hashverify
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/itchio/wharf/crc32c"
+	"lukechampine.com/blake3"
+)
+
+// Registry maps a digest algorithm name (as it appears in a Digest or
+// Repr-Digest header, lowercased) to a constructor for the hash.Hash
+// that computes it.
+type Registry struct {
+	ctors map[string]func() hash.Hash
+}
+
+// NewRegistry returns an empty Registry. Most callers want Default
+// instead, which already knows md5, sha-256, sha-512, crc32c and blake3.
+func NewRegistry() *Registry {
+	return &Registry{ctors: make(map[string]func() hash.Hash)}
+}
+
+// Register adds (or replaces) the constructor for a named algorithm.
+func (r *Registry) Register(name string, ctor func() hash.Hash) {
+	r.ctors[strings.ToLower(name)] = ctor
+}
+
+// New instantiates the hash.Hash registered for name, if any.
+func (r *Registry) New(name string) (hash.Hash, bool) {
+	ctor, ok := r.ctors[strings.ToLower(name)]
+	if !ok {
+		return nil, false
+	}
+	return ctor(), true
+}
+
+// Default is the registry butler verifies downloads against.
+var Default = NewRegistry()
+
+func init() {
+	Default.Register("md5", md5.New)
+	Default.Register("sha-256", sha256.New)
+	Default.Register("sha-512", sha512.New)
+	Default.Register("crc32c", func() hash.Hash { return crc32.New(crc32c.Table) })
+	Default.Register("blake3", func() hash.Hash { return blake3.New(32, nil) })
+}
+
+// Mismatch is returned by Verify when a computed digest doesn't match
+// what the server advertised.
+type Mismatch struct {
+	Algo     string
+	Expected []byte
+	Actual   []byte
+}
+
+func (m *Mismatch) Error() string {
+	return fmt.Sprintf("%s digest mismatch: wanted %x, got %x", m.Algo, m.Expected, m.Actual)
+}
+
+// ParseHeaders collects every digest it recognizes out of a response's
+// headers. The returned map is keyed by algorithm name exactly as
+// Default registers them (lowercase, e.g. "sha-256", "crc32c").
+func ParseHeaders(header http.Header) map[string][]byte {
+	digests := make(map[string][]byte)
+
+	for _, raw := range header[http.CanonicalHeaderKey("x-goog-hash")] {
+		addCommaSeparatedDigests(digests, raw)
+	}
+
+	for _, raw := range header[http.CanonicalHeaderKey("Digest")] {
+		addCommaSeparatedDigests(digests, raw)
+	}
+
+	for _, raw := range header[http.CanonicalHeaderKey("Repr-Digest")] {
+		addStructuredFieldDigests(digests, raw)
+	}
+
+	for key, values := range header {
+		lower := strings.ToLower(key)
+		if !strings.HasPrefix(lower, "x-amz-checksum-") {
+			continue
+		}
+		name := strings.TrimPrefix(lower, "x-amz-checksum-")
+		if name == "sha256" {
+			name = "sha-256"
+		}
+		for _, value := range values {
+			addDigest(digests, name, value)
+		}
+	}
+
+	return digests
+}
+
+func addCommaSeparatedDigests(digests map[string][]byte, raw string) {
+	for _, part := range strings.Split(raw, ",") {
+		part = strings.TrimSpace(part)
+		tokens := strings.SplitN(part, "=", 2)
+		if len(tokens) != 2 {
+			continue
+		}
+		addDigest(digests, tokens[0], tokens[1])
+	}
+}
+
+// addStructuredFieldDigests parses an RFC 9530 Repr-Digest value: an
+// RFC 8941 structured-field dictionary whose members are sf-binary
+// items, i.e. colon-wrapped base64 (`sha-256=:AAAA...:`), not the bare
+// base64 RFC 3230 Digest uses.
+func addStructuredFieldDigests(digests map[string][]byte, raw string) {
+	for _, part := range strings.Split(raw, ",") {
+		part = strings.TrimSpace(part)
+		tokens := strings.SplitN(part, "=", 2)
+		if len(tokens) != 2 {
+			continue
+		}
+
+		name := tokens[0]
+		value := strings.TrimSpace(tokens[1])
+		value = strings.TrimPrefix(value, ":")
+		value = strings.TrimSuffix(value, ":")
+
+		addDigest(digests, name, value)
+	}
+}
+
+func addDigest(digests map[string][]byte, name string, b64Value string) {
+	decoded, err := base64.StdEncoding.DecodeString(b64Value)
+	if err != nil {
+		return
+	}
+	digests[strings.ToLower(name)] = decoded
+}
+
+// VerifyWithPrecomputed is like Verify, but any algorithm already
+// present in precomputed (e.g. a CRC32C a caller combined from
+// per-chunk checksums as it streamed the file down) is checked against
+// that value directly instead of triggering a file read. Only the
+// algorithms in wanted that aren't covered by precomputed fall through
+// to a single Verify pass.
+func (r *Registry) VerifyWithPrecomputed(file string, wanted map[string][]byte, precomputed map[string][]byte) (checked map[string]bool, err error) {
+	checked = make(map[string]bool)
+	remaining := make(map[string][]byte)
+
+	for algo, expect := range wanted {
+		have, ok := precomputed[algo]
+		if !ok {
+			remaining[algo] = expect
+			continue
+		}
+
+		checked[algo] = true
+		if !bytes.Equal(expect, have) {
+			return checked, &Mismatch{Algo: algo, Expected: expect, Actual: have}
+		}
+	}
+
+	if len(remaining) == 0 {
+		return checked, nil
+	}
+
+	more, err := r.Verify(file, remaining)
+	for algo, ok := range more {
+		checked[algo] = ok
+	}
+	return checked, err
+}
+
+// Verify opens file once and computes every digest in wanted that the
+// Registry knows how to compute, wrapping an io.MultiWriter over the
+// matched hashers so the file is only read once regardless of how many
+// algorithms are requested. It returns the subset of wanted that it was
+// actually able to check, and the first mismatch found (if any).
+func (r *Registry) Verify(file string, wanted map[string][]byte) (checked map[string]bool, err error) {
+	checked = make(map[string]bool)
+
+	type entry struct {
+		algo   string
+		expect []byte
+		hasher hash.Hash
+	}
+
+	var entries []entry
+	var writers []io.Writer
+
+	for algo, expect := range wanted {
+		hasher, ok := r.New(algo)
+		if !ok {
+			continue
+		}
+		entries = append(entries, entry{algo: algo, expect: expect, hasher: hasher})
+		writers = append(writers, hasher)
+	}
+
+	if len(entries) == 0 {
+		return checked, nil
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return checked, err
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(io.MultiWriter(writers...), f); err != nil {
+		return checked, err
+	}
+
+	for _, e := range entries {
+		checked[e.algo] = true
+		actual := e.hasher.Sum(nil)
+		if !bytes.Equal(e.expect, actual) {
+			return checked, &Mismatch{Algo: e.algo, Expected: e.expect, Actual: actual}
+		}
+	}
+
+	return checked, nil
+}
@@ -0,0 +1,78 @@
+package hashverify
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseHeadersReprDigestSfBinary(t *testing.T) {
+	sum := []byte{0xde, 0xad, 0xbe, 0xef}
+	b64 := base64.StdEncoding.EncodeToString(sum)
+
+	header := http.Header{}
+	header.Set("Repr-Digest", "sha-256=:"+b64+":")
+
+	digests := ParseHeaders(header)
+	got, ok := digests["sha-256"]
+	if !ok {
+		t.Fatalf("Repr-Digest sf-binary value was not parsed: %v", digests)
+	}
+	if string(got) != string(sum) {
+		t.Fatalf("got %x, want %x", got, sum)
+	}
+}
+
+func TestParseHeadersDigestPlainBase64(t *testing.T) {
+	sum := []byte{0x01, 0x02, 0x03, 0x04}
+	b64 := base64.StdEncoding.EncodeToString(sum)
+
+	header := http.Header{}
+	header.Set("Digest", "md5="+b64)
+
+	digests := ParseHeaders(header)
+	got, ok := digests["md5"]
+	if !ok || string(got) != string(sum) {
+		t.Fatalf("got %x, ok=%v, want %x", got, ok, sum)
+	}
+}
+
+func TestVerifyWithPrecomputedSkipsFileRead(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hashverify-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "does-not-matter")
+	// Deliberately don't write this file: if Verify tried to open it
+	// for the precomputed algorithm, this test would fail.
+	_ = path
+
+	precomputed := map[string][]byte{"crc32c": {0x01, 0x02, 0x03, 0x04}}
+	wanted := map[string][]byte{"crc32c": {0x01, 0x02, 0x03, 0x04}}
+
+	checked, err := Default.VerifyWithPrecomputed(path, wanted, precomputed)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !checked["crc32c"] {
+		t.Fatalf("expected crc32c to be checked via precomputed value")
+	}
+}
+
+func TestVerifyWithPrecomputedMismatch(t *testing.T) {
+	precomputed := map[string][]byte{"crc32c": {0x01, 0x02, 0x03, 0x04}}
+	wanted := map[string][]byte{"crc32c": {0xff, 0xff, 0xff, 0xff}}
+
+	_, err := Default.VerifyWithPrecomputed("unused", wanted, precomputed)
+	if err == nil {
+		t.Fatal("expected a mismatch error")
+	}
+	if _, ok := err.(*Mismatch); !ok {
+		t.Fatalf("expected *Mismatch, got %T", err)
+	}
+}
@@ -0,0 +1,215 @@
+// Package ipc defines butler's stdout protocol: a single tagged
+// envelope, one per line, so a GUI frontend never has to guess a
+// message's shape from which fields happen to be present.
+package ipc
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/go-errors/errors"
+)
+
+// Mode picks how a Writer renders events: JSON for machine consumers,
+// human for a terminal.
+type Mode int
+
+const (
+	ModeHuman Mode = iota
+	ModeJSON
+)
+
+// Envelope is the one shape every line of butler's stdout takes.
+// Payload's concrete type is determined by Type: "log" -> Log,
+// "progress" -> Progress, "error" -> Error, "prompt" -> Prompt,
+// "result" -> Result, "heartbeat" -> Heartbeat.
+type Envelope struct {
+	Type    string          `json:"type"`
+	Time    string          `json:"time"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// Log is a human-readable line, e.g. progress commentary or a warning.
+type Log struct {
+	Level   string `json:"level"`
+	Message string `json:"message"`
+}
+
+// Progress reports how far through the current operation butler is, as
+// a fraction between 0 and 1.
+type Progress struct {
+	Percent float64 `json:"percent"`
+}
+
+// Error reports a fatal condition. Code identifies the kind of failure
+// for frontends that want to react to specific ones (e.g. retry on a
+// network error, but not on a corrupt download); Integrity is set
+// whenever the caller classifies the error as a data-integrity failure
+// (see IsIntegrityError in the main package); Stack, if present, is the
+// go-errors stack trace of the original error.
+type Error struct {
+	Message   string `json:"message"`
+	Code      string `json:"code,omitempty"`
+	Integrity bool   `json:"integrity"`
+	Stack     string `json:"stack,omitempty"`
+}
+
+// Prompt asks the frontend a question and expects a Result in reply on
+// whatever side channel the two sides have agreed on; butler itself
+// only ever emits these, it doesn't read the answer back over stdout.
+type Prompt struct {
+	Message string `json:"message"`
+}
+
+// Result carries the outcome of a command, for frontends that want a
+// single structured value instead of scraping Log lines.
+type Result struct {
+	Value interface{} `json:"value"`
+}
+
+// Heartbeat has no payload; it just tells a frontend butler is still
+// alive during a long quiet stretch (large file hashing, for example).
+type Heartbeat struct{}
+
+// CodedError lets an error opt into a stable Code for the Error event,
+// instead of getting classified only by its message.
+type CodedError interface {
+	error
+	Code() string
+}
+
+// Writer emits envelopes to an underlying stream, one JSON object per
+// line in ModeJSON, or a terse human-readable rendering in ModeHuman.
+type Writer struct {
+	out  io.Writer
+	mode Mode
+}
+
+// NewWriter wraps out for event emission in the given Mode.
+func NewWriter(out io.Writer, mode Mode) *Writer {
+	return &Writer{out: out, mode: mode}
+}
+
+func (w *Writer) emit(eventType string, payload interface{}) {
+	if w.mode == ModeJSON {
+		w.emitJSON(eventType, payload)
+		return
+	}
+	w.emitHuman(payload)
+}
+
+func (w *Writer) emitJSON(eventType string, payload interface{}) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return
+	}
+
+	env := &Envelope{
+		Type:    eventType,
+		Time:    time.Now().UTC().Format(time.RFC3339Nano),
+		Payload: body,
+	}
+
+	line, err := json.Marshal(env)
+	if err != nil {
+		return
+	}
+	fmt.Fprintln(w.out, string(line))
+}
+
+func (w *Writer) emitHuman(payload interface{}) {
+	switch p := payload.(type) {
+	case *Log:
+		fmt.Fprintln(w.out, p.Message)
+	case *Progress:
+		fmt.Fprintf(w.out, "%.0f%%\n", p.Percent*100)
+	case *Error:
+		fmt.Fprintln(w.out, "error:", p.Message)
+		if p.Stack != "" {
+			fmt.Fprintln(w.out, p.Stack)
+		}
+	case *Prompt:
+		fmt.Fprintln(w.out, p.Message)
+	case *Result:
+		fmt.Fprintln(w.out, p.Value)
+	case *Heartbeat:
+		// only machine consumers care about these
+	}
+}
+
+// Log emits an informational line.
+func (w *Writer) Log(format string, args ...interface{}) {
+	w.emit("log", &Log{Level: "info", Message: fmt.Sprintf(format, args...)})
+}
+
+// Progress reports fractional completion (0..1) of the current
+// operation.
+func (w *Writer) Progress(fraction float64) {
+	w.emit("progress", &Progress{Percent: fraction})
+}
+
+// Error reports a fatal error. integrity should be the result of
+// IsIntegrityError(err) at the call site.
+func (w *Writer) Error(err error, integrity bool) {
+	payload := &Error{
+		Message:   err.Error(),
+		Integrity: integrity,
+	}
+
+	if coded, ok := err.(CodedError); ok {
+		payload.Code = coded.Code()
+	}
+
+	if wrapped, ok := err.(*errors.Error); ok {
+		payload.Stack = wrapped.ErrorStack()
+	}
+
+	w.emit("error", payload)
+}
+
+// Prompt asks the user or frontend a question.
+func (w *Writer) Prompt(message string) {
+	w.emit("prompt", &Prompt{Message: message})
+}
+
+// Result reports the final outcome of a command.
+func (w *Writer) Result(value interface{}) {
+	w.emit("result", &Result{Value: value})
+}
+
+// Heartbeat signals that butler is still alive.
+func (w *Writer) Heartbeat() {
+	w.emit("heartbeat", &Heartbeat{})
+}
+
+// Reader consumes a line-delimited stream of Envelopes, as written by a
+// Writer in ModeJSON. It's the helper other Go programs can import to
+// read butler's stdout reliably instead of re-implementing the framing.
+type Reader struct {
+	scanner *bufio.Scanner
+}
+
+// NewReader wraps r for envelope-at-a-time reading.
+func NewReader(r io.Reader) *Reader {
+	return &Reader{scanner: bufio.NewScanner(r)}
+}
+
+// Next reads and decodes the next envelope, returning io.EOF once the
+// underlying stream is exhausted.
+func (r *Reader) Next() (*Envelope, error) {
+	if !r.scanner.Scan() {
+		if err := r.scanner.Err(); err != nil {
+			return nil, err
+		}
+		return nil, io.EOF
+	}
+
+	env := &Envelope{}
+	if err := json.Unmarshal(r.scanner.Bytes(), env); err != nil {
+		return nil, err
+	}
+	return env, nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/itchio/butler/brotlipatch"
+)
+
+// diffCmd implements `butler diff <old> <new> <patch>`: produce a
+// brotli-compressed binary diff that turns old into new.
+func diffCmd() {
+	if len(os.Args) < 5 {
+		die("Usage: butler diff <old> <new> <patch>")
+	}
+	oldPath, newPath, patchPath := os.Args[2], os.Args[3], os.Args[4]
+
+	if err := brotlipatch.Diff(oldPath, newPath, patchPath); err != nil {
+		dieErr(err)
+	}
+	msg(fmt.Sprintf("wrote patch %s", patchPath))
+}
+
+// applyCmd implements `butler apply <old> <patch> <new>`: reconstruct
+// new from old and a patch produced by diffCmd, verifying the result
+// against the patch's trailing SHA-256.
+func applyCmd() {
+	if len(os.Args) < 5 {
+		die("Usage: butler apply <old> <patch> <new>")
+	}
+	oldPath, patchPath, newPath := os.Args[2], os.Args[3], os.Args[4]
+
+	err := brotlipatch.Apply(oldPath, patchPath, newPath)
+	if err != nil {
+		if mismatch, ok := err.(*brotlipatch.HashMismatch); ok {
+			err = &BadHashErr{
+				Algo:     "sha-256",
+				Expected: mismatch.Expected,
+				Actual:   mismatch.Actual,
+			}
+		}
+		dieErr(err)
+	}
+	msg(fmt.Sprintf("wrote %s", newPath))
+}
@@ -0,0 +1,250 @@
+package pushsync
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/itchio/butler/comm"
+	"github.com/itchio/butler/hashverify"
+	"gopkg.in/kothar/brotli-go.v0/enc"
+)
+
+// blockQuality keeps per-block compression cheap: push already sends
+// fewer bytes than a full re-upload by skipping blocks the remote has,
+// so there's no need to spend brotli's higher qualities per block too.
+const blockQuality = 5
+
+// plannedBlock is one (path, index) pair in manifest order, numbered by
+// its position across the whole push so resume can refer to it by a
+// single integer.
+type plannedBlock struct {
+	seqIndex int
+	path     string
+	index    int
+}
+
+// Push sends every block of paths (relative to root) that the remote
+// doesn't already have over ch, resuming a previous attempt if root has
+// a matching .butler-push.resume sidecar, and returns the server's final
+// content-addressed BuildAck once every reassembled file has been
+// verified against it. onProgress, if non-nil, is called with the
+// fraction (0..1) of blocks sent so far; pushsync has no stdout of its
+// own, so callers that want --json progress events pass their writer's
+// Progress method here.
+func Push(ch io.ReadWriteCloser, root string, paths []string, compress bool, onProgress func(float64)) (*BuildAck, error) {
+	manifest, err := BuildManifest(root, paths)
+	if err != nil {
+		return nil, err
+	}
+
+	resume := loadResumeState(root, manifest)
+
+	if err := writeEnvelope(ch, "manifest", manifest); err != nil {
+		return nil, err
+	}
+
+	env, err := readEnvelope(ch)
+	if err != nil {
+		return nil, err
+	}
+	if env.Type != "missing" {
+		return nil, fmt.Errorf("pushsync: expected missing reply, got %q", env.Type)
+	}
+
+	var reply missingReply
+	if err := json.Unmarshal(env.Payload, &reply); err != nil {
+		return nil, err
+	}
+
+	plan := planBlocks(manifest, reply.Missing)
+	if err := sendBlocks(ch, root, plan, resume, compress, onProgress); err != nil {
+		return nil, err
+	}
+
+	if err := writeEnvelope(ch, "finalize", struct{}{}); err != nil {
+		return nil, err
+	}
+
+	env, err = readEnvelope(ch)
+	if err != nil {
+		return nil, err
+	}
+	if env.Type != "build-ack" {
+		return nil, fmt.Errorf("pushsync: expected build-ack, got %q", env.Type)
+	}
+
+	ack := &BuildAck{}
+	if err := json.Unmarshal(env.Payload, ack); err != nil {
+		return nil, err
+	}
+
+	if err := verifyBuild(root, manifest, ack); err != nil {
+		return nil, err
+	}
+
+	clearResumeState(root)
+	return ack, nil
+}
+
+// planBlocks flattens the manifest into the (path, index) pairs the
+// server asked for, in manifest order, each numbered by its position
+// across the whole push.
+func planBlocks(manifest *Manifest, missing map[string][]int) []plannedBlock {
+	var plan []plannedBlock
+	seq := 0
+
+	for _, fm := range manifest.Files {
+		wanted := make(map[int]bool)
+		for _, index := range missing[fm.Path] {
+			wanted[index] = true
+		}
+
+		for index := range fm.Blocks {
+			if wanted[index] {
+				plan = append(plan, plannedBlock{seqIndex: seq, path: fm.Path, index: index})
+			}
+			seq++
+		}
+	}
+
+	return plan
+}
+
+func sendBlocks(ch io.ReadWriteCloser, root string, plan []plannedBlock, resume *resumeState, compress bool, onProgress func(float64)) error {
+	params := enc.NewBrotliParams()
+	params.SetQuality(blockQuality)
+
+	for i, pb := range plan {
+		if pb.seqIndex <= resume.LastSeqIndex {
+			continue
+		}
+
+		payload, err := readBlock(root, pb.path, pb.index)
+		if err != nil {
+			return err
+		}
+
+		compressed := false
+		if compress {
+			if packed, err := enc.CompressBuffer(params, payload, make([]byte, 1)); err == nil && len(packed) < len(payload) {
+				payload = packed
+				compressed = true
+			}
+		}
+
+		header := blockHeader{Path: pb.path, Index: pb.index, Compressed: compressed, Length: len(payload)}
+		if err := writeEnvelope(ch, "block-header", header); err != nil {
+			return err
+		}
+		if _, err := ch.Write(payload); err != nil {
+			return err
+		}
+
+		ackEnv, err := readEnvelope(ch)
+		if err != nil {
+			return err
+		}
+		if ackEnv.Type != "block-ack" {
+			return fmt.Errorf("pushsync: expected block-ack, got %q", ackEnv.Type)
+		}
+		var ack blockAck
+		if err := json.Unmarshal(ackEnv.Payload, &ack); err != nil {
+			return err
+		}
+		if ack.SeqIndex != pb.seqIndex {
+			return fmt.Errorf("pushsync: expected ack for block %d, got ack for block %d", pb.seqIndex, ack.SeqIndex)
+		}
+
+		resume.LastSeqIndex = ack.SeqIndex
+		saveResumeState(root, resume)
+
+		fraction := float64(i+1) / float64(len(plan))
+		comm.Progress(fraction)
+		if onProgress != nil {
+			onProgress(fraction)
+		}
+	}
+
+	return nil
+}
+
+// verifyBuild cross-checks the server's reported per-file sha256 against
+// what's actually on disk locally, with one sha-256 Verify call per file
+// through the shared hash registry. A file the ack has no hash for is an
+// error.
+func verifyBuild(root string, manifest *Manifest, ack *BuildAck) error {
+	for _, fm := range manifest.Files {
+		hexHash, ok := ack.FileHashes[fm.Path]
+		if !ok {
+			return fmt.Errorf("pushsync: build-ack has no hash for %s", fm.Path)
+		}
+
+		expected, err := hex.DecodeString(hexHash)
+		if err != nil {
+			return err
+		}
+
+		_, err = hashverify.Default.Verify(filepath.Join(root, fm.Path), map[string][]byte{"sha-256": expected})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type resumeState struct {
+	ManifestHash string `json:"manifestHash"`
+	LastSeqIndex int    `json:"lastSeqIndex"`
+}
+
+func resumeStatePath(root string) string {
+	return filepath.Join(root, ".butler-push.resume")
+}
+
+func hashManifest(manifest *Manifest) string {
+	body, _ := json.Marshal(manifest)
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// loadResumeState returns the sidecar state for manifest if one exists
+// and still matches it (same files, same blocks), or a fresh state
+// starting at seq index -1 otherwise.
+func loadResumeState(root string, manifest *Manifest) *resumeState {
+	fresh := &resumeState{ManifestHash: hashManifest(manifest), LastSeqIndex: -1}
+
+	raw, err := ioutil.ReadFile(resumeStatePath(root))
+	if err != nil {
+		return fresh
+	}
+
+	state := &resumeState{}
+	if err := json.Unmarshal(raw, state); err != nil {
+		return fresh
+	}
+	if state.ManifestHash != fresh.ManifestHash {
+		comm.Debugf("push resume: manifest changed since last attempt, starting over")
+		return fresh
+	}
+
+	return state
+}
+
+func saveResumeState(root string, state *resumeState) {
+	raw, err := json.Marshal(state)
+	if err != nil {
+		return
+	}
+	ioutil.WriteFile(resumeStatePath(root), raw, 0666)
+}
+
+func clearResumeState(root string) {
+	os.Remove(resumeStatePath(root))
+}
@@ -0,0 +1,42 @@
+package pushsync
+
+import "testing"
+
+// TestPlanBlocksSkipsAlreadyAckedOnResume checks the guarantee attemptPush's
+// retry loop depends on: planBlocks numbers blocks by their position
+// across the whole manifest, so filtering its plan on a saved
+// LastSeqIndex, as sendBlocks does, skips exactly the blocks already
+// acked and nothing else.
+func TestPlanBlocksSkipsAlreadyAckedOnResume(t *testing.T) {
+	manifest := &Manifest{
+		Files: []FileManifest{
+			{Path: "a", Blocks: []BlockSignature{{}, {}, {}}},
+			{Path: "b", Blocks: []BlockSignature{{}, {}}},
+		},
+	}
+	missing := map[string][]int{
+		"a": {0, 1, 2},
+		"b": {0, 1},
+	}
+
+	full := planBlocks(manifest, missing)
+	if len(full) != 5 {
+		t.Fatalf("expected 5 planned blocks, got %d", len(full))
+	}
+
+	resume := &resumeState{LastSeqIndex: 2}
+	var remaining []plannedBlock
+	for _, pb := range full {
+		if pb.seqIndex <= resume.LastSeqIndex {
+			continue
+		}
+		remaining = append(remaining, pb)
+	}
+
+	if len(remaining) != 2 {
+		t.Fatalf("expected 2 blocks left after resuming from seq 2, got %d", len(remaining))
+	}
+	if remaining[0].path != "b" || remaining[0].index != 0 {
+		t.Fatalf("unexpected first remaining block: %+v", remaining[0])
+	}
+}
@@ -0,0 +1,129 @@
+// Package pushsync speaks the client side of butler's push protocol: a
+// framed JSON+binary exchange, carried over the `butler` SSH channel,
+// that lets a build be uploaded block-by-block, skipping whatever the
+// remote end already has.
+package pushsync
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// Every frame on the wire is a 4-byte big-endian length prefix followed
+// by that many bytes of JSON. Raw block payloads are the one exception:
+// a blockHeader frame is immediately followed by Length raw bytes, not
+// wrapped in JSON, so large builds don't pay base64 overhead.
+const maxFrameSize = 64 * 1024 * 1024
+
+func writeFrame(w io.Writer, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(body)))
+	if _, err := w.Write(length[:]); err != nil {
+		return err
+	}
+	_, err = w.Write(body)
+	return err
+}
+
+func readFrame(r io.Reader, v interface{}) error {
+	var length [4]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return err
+	}
+
+	size := binary.BigEndian.Uint32(length[:])
+	if size > maxFrameSize {
+		return fmt.Errorf("pushsync: frame of %d bytes exceeds limit of %d", size, maxFrameSize)
+	}
+
+	body := make([]byte, size)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return err
+	}
+
+	return json.Unmarshal(body, v)
+}
+
+// envelope tags every frame so the reading side can dispatch on Type
+// without guessing from shape.
+type envelope struct {
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+func writeEnvelope(w io.Writer, frameType string, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	return writeFrame(w, &envelope{Type: frameType, Payload: body})
+}
+
+func readEnvelope(r io.Reader) (*envelope, error) {
+	env := &envelope{}
+	if err := readFrame(r, env); err != nil {
+		return nil, err
+	}
+	return env, nil
+}
+
+// BlockSignature is the rsync-style signature of one fixed-size block: a
+// cheap weak checksum to rule out most blocks quickly, and a strong hash
+// to confirm an actual match.
+type BlockSignature struct {
+	Weak   uint32 `json:"weak"`
+	Strong string `json:"strong"` // hex-encoded sha256
+}
+
+// FileManifest describes one file as a sequence of block signatures.
+type FileManifest struct {
+	Path      string           `json:"path"`
+	Size      int64            `json:"size"`
+	BlockSize int              `json:"blockSize"`
+	Blocks    []BlockSignature `json:"blocks"`
+}
+
+// Manifest is what the client sends first: every file it intends to
+// push, broken into blocks the server can deduplicate against whatever
+// build it already has.
+type Manifest struct {
+	Files []FileManifest `json:"files"`
+}
+
+// missingReply is the server's response to a Manifest: for each path,
+// the indices of the blocks it doesn't already have and needs streamed.
+type missingReply struct {
+	Missing map[string][]int `json:"missing"`
+}
+
+// blockHeader precedes Length raw bytes of block payload on the wire.
+type blockHeader struct {
+	Path       string `json:"path"`
+	Index      int    `json:"index"`
+	Compressed bool   `json:"compressed"`
+	Length     int    `json:"length"`
+}
+
+// blockAck confirms the server has durably stored one block, keyed by
+// its position in the manifest's flattened (path, index) order, counting
+// every block whether sent or not, so the client can resume a dropped
+// connection without resending acked blocks.
+type blockAck struct {
+	SeqIndex int `json:"seqIndex"`
+}
+
+// BuildAck is the server's final response once every block has been
+// received and the files reassembled: a content-addressed id for the
+// build, plus the sha256 of each reassembled file so the client can
+// confirm nothing got corrupted in transit.
+type BuildAck struct {
+	BuildID    string            `json:"buildId"`
+	FileHashes map[string]string `json:"fileHashes"` // path -> hex sha256
+}